@@ -3,80 +3,438 @@ package connection
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/project-flogo/core/support/log"
+	"github.com/xdg-go/scram"
+	"github.com/youmark/pkcs8"
+)
+
+// securityProtocol values recognized for Settings.SecurityProtocol, mirroring Kafka's own naming.
+const (
+	securityProtocolPlaintext     = "PLAINTEXT"
+	securityProtocolSSL           = "SSL"
+	securityProtocolSASLPlaintext = "SASL_PLAINTEXT"
+	securityProtocolSASLSSL       = "SASL_SSL"
 )
 
 type Settings struct {
-	BrokerUrls string `md:"brokerUrls,required"` // The Kafka cluster to connect to
-	User       string `md:"user"`                // If connecting to a SASL enabled port, the user id to use for authentication
-	Password   string `md:"password"`            // If connecting to a SASL enabled port, the password to use for authentication
-	TrustStore string `md:"trustStore"`          // If connecting to a TLS secured port, the directory containing the certificates representing the trust chain for the connection. This is usually just the CACert used to sign the server's certificate
+	BrokerUrls       string `md:"brokerUrls,required"` // The Kafka cluster to connect to
+	User             string `md:"user"`                // If connecting to a SASL enabled port, the user id to use for authentication
+	Password         string `md:"password"`            // If connecting to a SASL enabled port, the password to use for authentication
+	TrustStore       string `md:"trustStore"`          // If connecting to a TLS secured port, the trust material for the connection: a directory or single file of PEM certificates, a literal PEM string (starting with "-----BEGIN"), or the special value "system" to trust the platform's CA pool
+	TrustStorePEM    []byte `md:"trustStorePEM"`       // Raw PEM encoded trust material, e.g. sourced from a Kubernetes secret mounted as bytes. Appended to whatever TrustStore resolves to, if anything
+	ClientCert       string `md:"clientCert"`          // If connecting with mutual TLS, the path to the PEM encoded client certificate to present to the broker
+	ClientKey        string `md:"clientKey"`           // If connecting with mutual TLS, the path to the PEM encoded private key matching ClientCert
+	KeyPassword      string `md:"keyPassword"`         // The password protecting ClientKey, if it is an encrypted PKCS#8 key
+	SkipVerify       bool   `md:"skipVerify"`          // If true, the broker's certificate chain and host name will not be verified. Only use this for testing against self-signed brokers
+	SecurityProtocol string `md:"securityProtocol"`    // How TLS and SASL are layered on the connection: PLAINTEXT/SASL_PLAINTEXT force TLS off, SSL/SASL_SSL force TLS on, and SASL_PLAINTEXT/SASL_SSL also require a SASL mechanism. Defaults to inferring TLS from TrustStore/TrustStorePEM and SASL from User/SASLMechanism if not set
+	SASLMechanism    string `md:"saslMechanism"`       // The SASL mechanism to use when User is set: PLAIN, SCRAM-SHA-256, SCRAM-SHA-512, OAUTHBEARER or GSSAPI. Defaults to PLAIN
+	Keytab           string `md:"keytab"`              // For GSSAPI, the path to the Kerberos keytab file for Principal
+	Principal        string `md:"principal"`           // For GSSAPI, the Kerberos principal to authenticate as
+	Realm            string `md:"realm"`               // For GSSAPI, the Kerberos realm
+	ServiceName      string `md:"serviceName"`         // For GSSAPI, the Kerberos service name of the broker
+	KerberosConfig   string `md:"kerberosConfig"`      // For GSSAPI, the path to krb5.conf
+
+	Compression     string `md:"compression"`     // Producer compression codec: none, gzip, snappy, lz4 or zstd. Defaults to none
+	RequiredAcks    string `md:"requiredAcks"`    // Producer acknowledgement level: none, leader or all. Defaults to all
+	Idempotent      bool   `md:"idempotent"`      // If true, enables the idempotent producer. Requires requiredAcks=all and forces a single in-flight request per connection
+	MaxMessageBytes int    `md:"maxMessageBytes"` // The largest message, in bytes, the producer will attempt to send. Defaults to sarama's built-in limit if 0
+	FlushFrequency  string `md:"flushFrequency"`  // How long the producer batches messages before flushing, e.g. "100ms". Defaults to flushing as fast as possible
+	FlushMessages   int    `md:"flushMessages"`   // The number of buffered messages that triggers a flush, regardless of FlushFrequency. Defaults to flushing after every message
+	RetryMax        int    `md:"retryMax"`        // The number of times to retry sending a message on failure. Defaults to 5
+
+	// TokenProvider supplies OAUTHBEARER tokens when SASLMechanism is OAUTHBEARER. It is set
+	// programmatically by the embedding activity/trigger rather than via metadata.
+	TokenProvider sarama.AccessTokenProvider
 }
 
 type KafkaConnection interface {
-	Producer() interface{}
-	Consumer() interface{}
+	Producer() (interface{}, error)
+	AsyncProducer() (interface{}, error)
+	Consumer() (interface{}, error)
+	ConsumerGroup(groupID string) (interface{}, error)
 	Stop() error
 }
 type KafkaConnect struct {
-	kafkaConfig  *sarama.Config
-	brokers      []string
-	syncProducer sarama.SyncProducer
-	consumer     sarama.Consumer
+	kafkaConfig *sarama.Config
+	brokers     []string
+	logger      log.Logger
+
+	mutex          sync.Mutex
+	syncProducer   sarama.SyncProducer
+	asyncProducer  sarama.AsyncProducer
+	consumer       sarama.Consumer
+	consumerGroups map[string]sarama.ConsumerGroup
 }
 
-func (c *KafkaConnect) Producer() interface{} {
-	return c.syncProducer
+// Producer lazily creates (and memoizes) the sarama.SyncProducer for this connection.
+func (c *KafkaConnect) Producer() (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.syncProducer == nil {
+		syncProducer, err := sarama.NewSyncProducer(c.brokers, c.kafkaConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a Kafka SyncProducer.  Check any TLS or SASL parameters carefully.  Reason given: [%s]", err)
+		}
+		c.syncProducer = syncProducer
+	}
+
+	return c.syncProducer, nil
 }
 
-func (c *KafkaConnect) Consumer() interface{} {
-	return c.consumer
+// AsyncProducer lazily creates (and memoizes) the sarama.AsyncProducer for this connection.
+func (c *KafkaConnect) AsyncProducer() (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.asyncProducer == nil {
+		asyncProducer, err := sarama.NewAsyncProducer(c.brokers, c.kafkaConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a Kafka AsyncProducer.  Check any TLS or SASL parameters carefully.  Reason given: [%s]", err)
+		}
+		c.asyncProducer = asyncProducer
+	}
+
+	return c.asyncProducer, nil
 }
 
-func (c *KafkaConnect) Stop() error {
-	err := c.syncProducer.Close()
-	if err != nil {
-		return err
+// Consumer lazily creates (and memoizes) the low-level sarama.Consumer for this connection.
+func (c *KafkaConnect) Consumer() (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.consumer == nil {
+		consumer, err := sarama.NewConsumer(c.brokers, c.kafkaConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Kafka consumer for reason [%s]", err)
+		}
+		c.consumer = consumer
+	}
+
+	return c.consumer, nil
+}
+
+// ConsumerGroup lazily creates (and memoizes, per groupID) a sarama.ConsumerGroup for Kafka-managed
+// partition assignment.
+func (c *KafkaConnect) ConsumerGroup(groupID string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if consumerGroup, ok := c.consumerGroups[groupID]; ok {
+		return consumerGroup, nil
 	}
-	err = c.consumer.Close()
+
+	consumerGroup, err := sarama.NewConsumerGroup(c.brokers, groupID, c.kafkaConfig)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create Kafka consumer group [%s] for reason [%s]", groupID, err)
 	}
-	return nil
 
+	if c.consumerGroups == nil {
+		c.consumerGroups = make(map[string]sarama.ConsumerGroup)
+	}
+	c.consumerGroups[groupID] = consumerGroup
+
+	return consumerGroup, nil
+}
+
+// Stop tears down every producer/consumer this connection has lazily created. The async producer is
+// closed first so its Errors()/Successes() channels can be fully drained before we return.
+func (c *KafkaConnect) Stop() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var firstErr error
+	recordErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if c.asyncProducer != nil {
+		var drainWg sync.WaitGroup
+		drainWg.Add(2)
+		go func() {
+			defer drainWg.Done()
+			for range c.asyncProducer.Successes() {
+			}
+		}()
+		go func() {
+			defer drainWg.Done()
+			for err := range c.asyncProducer.Errors() {
+				c.logger.Errorf("Kafka async producer error during shutdown: [%s]", err)
+			}
+		}()
+		c.asyncProducer.AsyncClose()
+		drainWg.Wait()
+	}
+
+	if c.syncProducer != nil {
+		recordErr(c.syncProducer.Close())
+	}
+
+	if c.consumer != nil {
+		recordErr(c.consumer.Close())
+	}
+
+	for groupID, consumerGroup := range c.consumerGroups {
+		if err := consumerGroup.Close(); err != nil {
+			c.logger.Errorf("failed to close Kafka consumer group [%s]: [%s]", groupID, err)
+			recordErr(err)
+		}
+	}
+
+	return firstErr
+}
+
+// resetClients closes and discards any lazily created producers/consumers without tearing down the
+// connection itself, so the next call to Producer()/AsyncProducer()/Consumer()/ConsumerGroup() rebuilds
+// them. Used by the pooled connection's health check to recover from a broker it has lost contact with.
+func (c *KafkaConnect) resetClients(logger log.Logger) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.syncProducer != nil {
+		if err := c.syncProducer.Close(); err != nil {
+			logger.Warnf("failed to close stale Kafka sync producer: [%s]", err)
+		}
+		c.syncProducer = nil
+	}
+
+	if c.asyncProducer != nil {
+		asyncProducer := c.asyncProducer
+		go func() {
+			for range asyncProducer.Successes() {
+			}
+		}()
+		go func() {
+			for err := range asyncProducer.Errors() {
+				logger.Warnf("stale Kafka async producer error during reset: [%s]", err)
+			}
+		}()
+		asyncProducer.AsyncClose()
+		c.asyncProducer = nil
+	}
+
+	if c.consumer != nil {
+		if err := c.consumer.Close(); err != nil {
+			logger.Warnf("failed to close stale Kafka consumer: [%s]", err)
+		}
+		c.consumer = nil
+	}
+
+	for groupID, consumerGroup := range c.consumerGroups {
+		if err := consumerGroup.Close(); err != nil {
+			logger.Warnf("failed to close stale Kafka consumer group [%s]: [%s]", groupID, err)
+		}
+	}
+	c.consumerGroups = nil
 }
 
+// getConnectionKey folds every field that shapes the resulting sarama.Config into a single string, so
+// that two Settings values which would configure TLS, SASL or the producer differently never collide on
+// the same pooled connection. TokenProvider can't be folded in meaningfully (it's a callback, not
+// metadata), so callers relying on OAUTHBEARER with distinct token providers but otherwise identical
+// Settings should expect to share a connection.
 func getConnectionKey(settings *Settings) string {
 
 	var connKey string
 
 	connKey += settings.BrokerUrls
-	if settings.TrustStore != "" {
-		connKey += settings.TrustStore
-	}
-	if settings.User != "" {
-		connKey += settings.User
-	}
+	connKey += "|" + settings.TrustStore
+	connKey += "|" + string(settings.TrustStorePEM)
+	connKey += "|" + strconv.FormatBool(settings.SkipVerify)
+	connKey += "|" + settings.ClientCert
+	connKey += "|" + settings.ClientKey
+	connKey += "|" + settings.KeyPassword
+	connKey += "|" + settings.User
+	connKey += "|" + settings.Password
+	connKey += "|" + settings.SecurityProtocol
+	connKey += "|" + settings.SASLMechanism
+	connKey += "|" + settings.Keytab
+	connKey += "|" + settings.Principal
+	connKey += "|" + settings.Realm
+	connKey += "|" + settings.ServiceName
+	connKey += "|" + settings.KerberosConfig
+	connKey += "|" + settings.Compression
+	connKey += "|" + settings.RequiredAcks
+	connKey += "|" + strconv.FormatBool(settings.Idempotent)
+	connKey += "|" + strconv.Itoa(settings.MaxMessageBytes)
+	connKey += "|" + settings.FlushFrequency
+	connKey += "|" + strconv.Itoa(settings.FlushMessages)
+	connKey += "|" + strconv.Itoa(settings.RetryMax)
 
 	return connKey
 }
 
+// healthCheckInterval is how often a pooled connection's health check refreshes broker metadata.
+const healthCheckInterval = 30 * time.Second
+
+var (
+	connectionsMutex sync.Mutex
+	connections      = make(map[string]*pooledConnection)
+)
+
+// pooledConnection is the shared, reference counted handle a connection cache entry tracks. Multiple
+// triggers/activities configured with identical Settings share one of these.
+type pooledConnection struct {
+	*KafkaConnect
+
+	refCount        int
+	stopHealthCheck chan struct{}
+
+	healthMutex  sync.Mutex
+	healthClient sarama.Client
+}
+
+// pooledConnectionHandle is what callers of getKafkaConnection actually receive. Its Stop() releases
+// this caller's reference rather than tearing down the shared connection outright.
+type pooledConnectionHandle struct {
+	key    string
+	logger log.Logger
+	pooled *pooledConnection
+}
+
+func (h *pooledConnectionHandle) Producer() (interface{}, error) { return h.pooled.Producer() }
+func (h *pooledConnectionHandle) AsyncProducer() (interface{}, error) {
+	return h.pooled.AsyncProducer()
+}
+func (h *pooledConnectionHandle) Consumer() (interface{}, error) { return h.pooled.Consumer() }
+func (h *pooledConnectionHandle) ConsumerGroup(groupID string) (interface{}, error) {
+	return h.pooled.ConsumerGroup(groupID)
+}
+func (h *pooledConnectionHandle) Stop() error { return releaseConnection(h.logger, h.key) }
+
+// getKafkaConnection returns a shared KafkaConnection for settings, building one lazily and caching it
+// by getConnectionKey. Callers sharing identical Settings share the same underlying producers and
+// consumers; each caller's Stop() only decrements the reference count, so one trigger/activity shutting
+// down doesn't tear down a connection still in use elsewhere.
 func getKafkaConnection(logger log.Logger, settings *Settings) (KafkaConnection, error) {
 
-	newConn := &KafkaConnect{}
+	key := getConnectionKey(settings)
+
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if pooled, ok := connections[key]; ok {
+		pooled.refCount++
+		logger.Debugf("Reusing pooled Kafka connection [%s]; refCount now [%d]", key, pooled.refCount)
+		return &pooledConnectionHandle{key: key, logger: logger, pooled: pooled}, nil
+	}
+
+	kafkaConnect, err := newKafkaConnect(logger, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	pooled := &pooledConnection{
+		KafkaConnect:    kafkaConnect,
+		refCount:        1,
+		stopHealthCheck: make(chan struct{}),
+	}
+	connections[key] = pooled
+	go pooled.runHealthCheck(logger, key)
+
+	logger.Debugf("Created new pooled Kafka connection [%s]", key)
+	return &pooledConnectionHandle{key: key, logger: logger, pooled: pooled}, nil
+}
+
+// releaseConnection decrements the refcount for key, tearing down the pooled connection and stopping
+// its health check once the last reference is released. The actual teardown I/O runs outside
+// connectionsMutex so a slow Stop() for one broker doesn't block getKafkaConnection/releaseConnection
+// for unrelated connections.
+func releaseConnection(logger log.Logger, key string) error {
+
+	connectionsMutex.Lock()
+
+	pooled, ok := connections[key]
+	if !ok {
+		connectionsMutex.Unlock()
+		return nil
+	}
+
+	pooled.refCount--
+	logger.Debugf("Released pooled Kafka connection [%s]; refCount now [%d]", key, pooled.refCount)
+	if pooled.refCount > 0 {
+		connectionsMutex.Unlock()
+		return nil
+	}
+
+	delete(connections, key)
+	connectionsMutex.Unlock()
+
+	close(pooled.stopHealthCheck)
+
+	pooled.healthMutex.Lock()
+	if pooled.healthClient != nil {
+		pooled.healthClient.Close()
+	}
+	pooled.healthMutex.Unlock()
+
+	return pooled.KafkaConnect.Stop()
+}
+
+// runHealthCheck periodically refreshes broker metadata for this connection, rebuilding its producers
+// and consumers if the refresh reveals the brokers are no longer reachable.
+func (p *pooledConnection) runHealthCheck(logger log.Logger, key string) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopHealthCheck:
+			return
+		case <-ticker.C:
+			p.checkHealth(logger, key)
+		}
+	}
+}
+
+func (p *pooledConnection) checkHealth(logger log.Logger, key string) {
+	p.healthMutex.Lock()
+	defer p.healthMutex.Unlock()
+
+	if p.healthClient == nil {
+		client, err := sarama.NewClient(p.brokers, p.kafkaConfig)
+		if err != nil {
+			logger.Warnf("Kafka health check for [%s] could not create a client: [%s]", key, err)
+			return
+		}
+		p.healthClient = client
+	}
+
+	if err := p.healthClient.RefreshMetadata(); err != nil {
+		logger.Warnf("Kafka health check for [%s] detected a broken connection, rebuilding: [%s]", key, err)
+		p.healthClient.Close()
+		p.healthClient = nil
+		p.resetClients(logger)
+	}
+}
+
+// newKafkaConnect builds a fresh, un-pooled KafkaConnect from settings. getKafkaConnection is the
+// pooling entry point callers should use; this is only called when no cached connection exists yet.
+func newKafkaConnect(logger log.Logger, settings *Settings) (*KafkaConnect, error) {
+
+	newConn := &KafkaConnect{logger: logger}
 
 	newConn.kafkaConfig = sarama.NewConfig()
 	newConn.kafkaConfig.Producer.Return.Errors = true
-	newConn.kafkaConfig.Producer.RequiredAcks = sarama.WaitForAll
-	newConn.kafkaConfig.Producer.Retry.Max = 5
 	newConn.kafkaConfig.Producer.Return.Successes = true
+	newConn.kafkaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+	newConn.kafkaConfig.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+
+	if err := configureProducer(newConn.kafkaConfig, settings); err != nil {
+		return nil, err
+	}
 
 	brokerUrls := strings.Split(settings.BrokerUrls, ",")
 
@@ -104,46 +462,135 @@ func getKafkaConnection(logger log.Logger, settings *Settings) (KafkaConnection,
 		see: https://issues.apache.org/jira/browse/KAFKA-3647
 		for more info
 	*/
-	if settings.TrustStore != "" {
-		if trustPool, err := getCerts(logger, settings.TrustStore); err == nil {
-			config := tls.Config{
-				RootCAs:            trustPool,
-				InsecureSkipVerify: true}
-			newConn.kafkaConfig.Net.TLS.Enable = true
-			newConn.kafkaConfig.Net.TLS.Config = &config
-
-			logger.Debugf("Kafka initialized truststore from [%v]", settings.TrustStore)
-		} else {
-			return nil, err
+	securityProtocol := strings.ToUpper(settings.SecurityProtocol)
+	enableTLS := settings.TrustStore != "" || len(settings.TrustStorePEM) > 0
+
+	switch securityProtocol {
+	case "":
+		// inferred above from TrustStore/TrustStorePEM
+	case securityProtocolSSL, securityProtocolSASLSSL:
+		enableTLS = true
+	case securityProtocolPlaintext, securityProtocolSASLPlaintext:
+		enableTLS = false
+	default:
+		return nil, fmt.Errorf("unsupported securityProtocol [%s], must be one of PLAINTEXT, SSL, SASL_PLAINTEXT or SASL_SSL", settings.SecurityProtocol)
+	}
+
+	if enableTLS {
+		var trustPool *x509.CertPool
+		if settings.TrustStore != "" || len(settings.TrustStorePEM) > 0 {
+			pool, err := getCerts(logger, settings)
+			if err != nil {
+				return nil, err
+			}
+			trustPool = pool
+		}
+
+		config := tls.Config{
+			RootCAs:            trustPool,
+			InsecureSkipVerify: settings.SkipVerify}
+
+		if settings.ClientCert != "" {
+			clientCert, err := getClientCertificate(settings)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{clientCert}
+			logger.Debugf("Kafka initialized client certificate from [%v]", settings.ClientCert)
 		}
+
+		newConn.kafkaConfig.Net.TLS.Enable = true
+		newConn.kafkaConfig.Net.TLS.Config = &config
+
+		logger.Debugf("Kafka initialized truststore from [%v]", settings.TrustStore)
 	}
 
 	// SASL
-	if settings.User != "" {
-		if len(settings.Password) == 0 {
-			return nil, fmt.Errorf("password not provided for user: %s", settings.User)
+	saslByProtocol := securityProtocol == securityProtocolSASLPlaintext || securityProtocol == securityProtocolSASLSSL
+	saslInferred := securityProtocol == "" && (settings.User != "" || settings.SASLMechanism != "")
+	if saslByProtocol || saslInferred {
+
+		if err := configureSASL(logger, newConn.kafkaConfig, settings); err != nil {
+			return nil, err
 		}
-		newConn.kafkaConfig.Net.SASL.Enable = true
-		newConn.kafkaConfig.Net.SASL.User = settings.User
-		newConn.kafkaConfig.Net.SASL.Password = settings.Password
-		logger.Debugf("Kafka SASL params initialized; user [%v]", settings.User)
 	}
 
-	syncProducer, err := sarama.NewSyncProducer(newConn.brokers, newConn.kafkaConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create a Kafka SyncProducer.  Check any TLS or SASL parameters carefully.  Reason given: [%s]", err)
+	// Producers and consumers are created lazily on first use via Producer()/AsyncProducer()/
+	// Consumer()/ConsumerGroup() so that a connection only needing one side doesn't pay for, or
+	// fail on, setting up the other.
+	return newConn, nil
+}
+
+// configureProducer maps the producer tuning settings onto kafkaConfig, applying sarama's own
+// idempotent-producer constraints and rejecting combinations sarama would otherwise refuse at
+// NewSyncProducer/NewAsyncProducer time.
+func configureProducer(kafkaConfig *sarama.Config, settings *Settings) error {
+
+	requiredAcks := sarama.WaitForAll
+	switch strings.ToLower(settings.RequiredAcks) {
+	case "", "all":
+		requiredAcks = sarama.WaitForAll
+	case "leader":
+		requiredAcks = sarama.WaitForLocal
+	case "none":
+		requiredAcks = sarama.NoResponse
+	default:
+		return fmt.Errorf("unsupported requiredAcks [%s], must be one of none, leader or all", settings.RequiredAcks)
 	}
 
-	newConn.syncProducer = syncProducer
+	if settings.Idempotent && requiredAcks != sarama.WaitForAll {
+		return fmt.Errorf("idempotent producer requires requiredAcks=all, got [%s]", settings.RequiredAcks)
+	}
 
-	kafkaConsumer, err := sarama.NewConsumer(brokers, newConn.kafkaConfig)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Kafka consumer for reason [%s]", err)
+	switch strings.ToLower(settings.Compression) {
+	case "", "none":
+		kafkaConfig.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		kafkaConfig.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		kafkaConfig.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		kafkaConfig.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		kafkaConfig.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return fmt.Errorf("unsupported compression [%s], must be one of none, gzip, snappy, lz4 or zstd", settings.Compression)
 	}
 
-	newConn.consumer = kafkaConsumer
+	kafkaConfig.Producer.RequiredAcks = requiredAcks
+	kafkaConfig.Producer.Idempotent = settings.Idempotent
 
-	return newConn, nil
+	kafkaConfig.Producer.Retry.Max = 5
+	if settings.RetryMax > 0 {
+		kafkaConfig.Producer.Retry.Max = settings.RetryMax
+	}
+
+	if settings.MaxMessageBytes > 0 {
+		kafkaConfig.Producer.MaxMessageBytes = settings.MaxMessageBytes
+	}
+
+	if settings.FlushFrequency != "" {
+		flushFrequency, err := time.ParseDuration(settings.FlushFrequency)
+		if err != nil {
+			return fmt.Errorf("flushFrequency [%s] is not a valid duration: [%s]", settings.FlushFrequency, err)
+		}
+		kafkaConfig.Producer.Flush.Frequency = flushFrequency
+	}
+
+	if settings.FlushMessages > 0 {
+		kafkaConfig.Producer.Flush.Messages = settings.FlushMessages
+	}
+
+	if settings.Idempotent {
+		// sarama requires a single in-flight request per connection, and at least one retry, for the
+		// idempotent producer to guarantee ordering.
+		kafkaConfig.Net.MaxOpenRequests = 1
+		if kafkaConfig.Producer.Retry.Max < 1 {
+			kafkaConfig.Producer.Retry.Max = 1
+		}
+	}
+
+	return nil
 }
 
 // validateBrokerUrl ensures that this string meets the host:port definition of a kafka host spec
@@ -161,40 +608,251 @@ func validateBrokerUrl(broker string) error {
 	return nil
 }
 
-func getCerts(logger log.Logger, trustStore string) (*x509.CertPool, error) {
-	certPool := x509.NewCertPool()
+// configureSASL wires the requested SASL mechanism onto kafkaConfig. Settings.User/Password are used
+// for PLAIN and the SCRAM mechanisms; GSSAPI and OAUTHBEARER draw on their own dedicated settings.
+func configureSASL(logger log.Logger, kafkaConfig *sarama.Config, settings *Settings) error {
+
+	mechanism := settings.SASLMechanism
+	if mechanism == "" {
+		mechanism = sarama.SASLTypePlaintext
+	}
+
+	kafkaConfig.Net.SASL.Enable = true
+	kafkaConfig.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+
+	switch mechanism {
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if len(settings.Password) == 0 {
+			return fmt.Errorf("password not provided for user: %s", settings.User)
+		}
+		kafkaConfig.Net.SASL.User = settings.User
+		kafkaConfig.Net.SASL.Password = settings.Password
+
+		if mechanism == sarama.SASLTypeSCRAMSHA256 {
+			kafkaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &xdgSCRAMClient{HashGeneratorFcn: scram.SHA256}
+			}
+		} else if mechanism == sarama.SASLTypeSCRAMSHA512 {
+			kafkaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &xdgSCRAMClient{HashGeneratorFcn: scram.SHA512}
+			}
+		}
+
+	case sarama.SASLTypeOAuth:
+		if settings.TokenProvider == nil {
+			return fmt.Errorf("saslMechanism OAUTHBEARER requires a TokenProvider to be configured")
+		}
+		kafkaConfig.Net.SASL.TokenProvider = settings.TokenProvider
+
+	case sarama.SASLTypeGSSAPI:
+		if settings.Keytab == "" || settings.Principal == "" {
+			return fmt.Errorf("saslMechanism GSSAPI requires keytab and principal to be configured")
+		}
+		kafkaConfig.Net.SASL.GSSAPI = sarama.GSSAPIConfig{
+			AuthType:           sarama.KRB5_KEYTAB_AUTH,
+			KeyTabPath:         settings.Keytab,
+			KerberosConfigPath: settings.KerberosConfig,
+			ServiceName:        settings.ServiceName,
+			Username:           settings.Principal,
+			Realm:              settings.Realm,
+		}
+
+	default:
+		return fmt.Errorf("unsupported saslMechanism [%s]", settings.SASLMechanism)
+	}
+
+	logger.Debugf("Kafka SASL params initialized; mechanism [%v], user [%v]", mechanism, settings.User)
+	return nil
+}
+
+// xdgSCRAMClient adapts github.com/xdg-go/scram to sarama's SCRAMClient interface for the
+// SCRAM-SHA-256/SCRAM-SHA-512 mechanisms.
+type xdgSCRAMClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *xdgSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+func (c *xdgSCRAMClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *xdgSCRAMClient) Done() bool {
+	return c.ClientConversation.Done()
+}
+
+// getClientCertificate loads the client keypair used for mutual TLS authentication. ClientKey may be an
+// unencrypted PKCS#1/PKCS#8 key, or a password protected PKCS#8 key in which case KeyPassword must be set.
+func getClientCertificate(settings *Settings) (tls.Certificate, error) {
+
+	if settings.ClientKey == "" {
+		return tls.Certificate{}, fmt.Errorf("clientKey must be provided along with clientCert for mutual TLS")
+	}
+
+	certBytes, err := ioutil.ReadFile(settings.ClientCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read client certificate [%s] for reason: [%s]", settings.ClientCert, err)
+	}
+
+	keyBytes, err := ioutil.ReadFile(settings.ClientKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read client key [%s] for reason: [%s]", settings.ClientKey, err)
+	}
+
+	if settings.KeyPassword == "" {
+		clientCert, err := tls.X509KeyPair(certBytes, keyBytes)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to load client keypair [%s]/[%s] for reason: [%s]", settings.ClientCert, settings.ClientKey, err)
+		}
+		return clientCert, nil
+	}
+
+	keyBlock, _ := pem.Decode(keyBytes)
+	if keyBlock == nil {
+		return tls.Certificate{}, fmt.Errorf("failed to decode PEM block from client key [%s]", settings.ClientKey)
+	}
+
+	privateKey, err := pkcs8.ParsePKCS8PrivateKey(keyBlock.Bytes, []byte(settings.KeyPassword))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to decrypt PKCS#8 client key [%s] for reason: [%s]", settings.ClientKey, err)
+	}
+
+	var chain [][]byte
+	rest := certBytes
+	for {
+		var certBlock *pem.Block
+		certBlock, rest = pem.Decode(rest)
+		if certBlock == nil {
+			break
+		}
+		if certBlock.Type == "CERTIFICATE" {
+			chain = append(chain, certBlock.Bytes)
+		}
+	}
 
-	fileInfo, err := os.Stat(trustStore)
+	if len(chain) == 0 {
+		return tls.Certificate{}, fmt.Errorf("failed to decode any CERTIFICATE PEM blocks from client certificate [%s]", settings.ClientCert)
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
 	if err != nil {
-		return certPool, fmt.Errorf("Truststore [%s] does not exist", trustStore)
+		return tls.Certificate{}, fmt.Errorf("failed to parse client certificate [%s] for reason: [%s]", settings.ClientCert, err)
+	}
+
+	return tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  privateKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// systemTrustStore is the special Settings.TrustStore value meaning "trust the platform's CA pool".
+const systemTrustStore = "system"
+
+// pemBeginMarker identifies a Settings.TrustStore value that is a literal PEM blob rather than a path.
+const pemBeginMarker = "-----BEGIN"
+
+// getCerts resolves Settings.TrustStore/TrustStorePEM into a single *x509.CertPool. TrustStore may be a
+// directory of PEM files (the original behavior), a single PEM file, a literal PEM string, or "system"
+// to start from the platform's trust store. TrustStorePEM, if set, is appended on top of whatever
+// TrustStore resolved to so the two can be combined, e.g. a Kubernetes secret layered onto "system".
+func getCerts(logger log.Logger, settings *Settings) (*x509.CertPool, error) {
+
+	var certPool *x509.CertPool
+	var loadedAny bool
+
+	switch {
+	case settings.TrustStore == systemTrustStore:
+		systemPool, err := x509.SystemCertPool()
+		if err != nil || systemPool == nil {
+			systemPool = x509.NewCertPool()
+		}
+		certPool = systemPool
+		loadedAny = true
+
+	case strings.HasPrefix(strings.TrimSpace(settings.TrustStore), pemBeginMarker):
+		certPool = x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM([]byte(settings.TrustStore)) {
+			return nil, fmt.Errorf("failed to parse any trusted certificates from the literal trustStore PEM value")
+		}
+		loadedAny = true
+
+	case settings.TrustStore != "":
+		certPool = x509.NewCertPool()
+
+		fileInfo, err := os.Stat(settings.TrustStore)
+		if err != nil {
+			return nil, fmt.Errorf("Truststore [%s] does not exist", settings.TrustStore)
+		}
+
+		if fileInfo.Mode().IsDir() {
+			if err := appendCertsFromDir(logger, certPool, settings.TrustStore); err != nil {
+				return nil, err
+			}
+		} else {
+			trustCertBytes, err := ioutil.ReadFile(settings.TrustStore)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read trustStore file [%s] for reason: [%s]", settings.TrustStore, err)
+			}
+			if !certPool.AppendCertsFromPEM(trustCertBytes) {
+				return nil, fmt.Errorf("failed to parse any trusted certificates from trustStore file [%s]", settings.TrustStore)
+			}
+		}
+		loadedAny = true
+
+	default:
+		certPool = x509.NewCertPool()
 	}
 
-	switch mode := fileInfo.Mode(); {
-	case mode.IsDir():
-		break
-	case mode.IsRegular():
-		return certPool, fmt.Errorf("TrustStore [%s] is not a directory.  Must be a directory containing trusted certificates in PEM format",
-			trustStore)
+	if len(settings.TrustStorePEM) > 0 {
+		if !certPool.AppendCertsFromPEM(settings.TrustStorePEM) {
+			return nil, fmt.Errorf("failed to parse any trusted certificates from trustStorePEM")
+		}
+		loadedAny = true
 	}
 
-	trustedCertFiles, err := ioutil.ReadDir(trustStore)
+	if !loadedAny {
+		return nil, fmt.Errorf("no trust material configured; set trustStore or trustStorePEM")
+	}
+
+	return certPool, nil
+}
+
+// appendCertsFromDir reads every file in dir and appends whatever PEM certificates it contains to pool,
+// matching the historical directory-of-certs TrustStore behavior.
+func appendCertsFromDir(logger log.Logger, pool *x509.CertPool, dir string) error {
+
+	trustedCertFiles, err := ioutil.ReadDir(dir)
 	if err != nil || len(trustedCertFiles) == 0 {
-		return certPool, fmt.Errorf("failed to read trusted certificates from [%s]  Must be a directory containing trusted certificates in PEM format", trustStore)
+		return fmt.Errorf("failed to read trusted certificates from [%s]  Must be a directory containing trusted certificates in PEM format", dir)
 	}
 
+	var appended bool
 	for _, trustCertFile := range trustedCertFiles {
-		fqfName := fmt.Sprintf("%s%c%s", trustStore, os.PathSeparator, trustCertFile.Name())
+		fqfName := fmt.Sprintf("%s%c%s", dir, os.PathSeparator, trustCertFile.Name())
 		trustCertBytes, err := ioutil.ReadFile(fqfName)
 		if err != nil {
 			logger.Warnf("Failed to read trusted certificate [%s] ... continuing", trustCertFile.Name())
-		} else if trustCertBytes != nil {
-			certPool.AppendCertsFromPEM(trustCertBytes)
+			continue
+		}
+		if pool.AppendCertsFromPEM(trustCertBytes) {
+			appended = true
 		}
 	}
 
-	if len(certPool.Subjects()) < 1 {
-		return certPool, fmt.Errorf("failed to read trusted certificates from [%s]  After processing all files in the directory no valid trusted certs were found", trustStore)
+	if !appended {
+		return fmt.Errorf("failed to read trusted certificates from [%s]  After processing all files in the directory no valid trusted certs were found", dir)
 	}
 
-	return certPool, nil
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,300 @@
+package connection
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/project-flogo/core/support/log"
+	"github.com/youmark/pkcs8"
+)
+
+var testLogger = log.NewLogger("kafka-connection-test")
+
+// generateTestCert creates a self-signed PEM certificate and private key for name, optionally signed by
+// signer/signerKey to build a chain. Returns the certificate PEM and the generated ECDSA private key.
+func generateTestCert(t *testing.T, name string, signer *x509.Certificate, signerKey crypto.Signer) (certPEM []byte, key *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key for [%s]: [%s]", name, err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+	}
+
+	parent := template
+	parentKey := crypto.Signer(key)
+	if signer != nil {
+		parent = signer
+		parentKey = signerKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate for [%s]: [%s]", name, err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return certPEM, key
+}
+
+func TestGetClientCertificate(t *testing.T) {
+
+	leafPEM, leafKey := generateTestCert(t, "leaf", nil, nil)
+	intermediatePEM, _ := generateTestCert(t, "intermediate", nil, nil)
+	chainPEM := append(append([]byte{}, leafPEM...), intermediatePEM...)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(leafKey)
+	if err != nil {
+		t.Fatalf("failed to marshal client key: [%s]", err)
+	}
+	plainKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	encryptedDER, err := pkcs8.MarshalPrivateKey(leafKey, []byte("s3cret"), nil)
+	if err != nil {
+		t.Fatalf("failed to marshal encrypted client key: [%s]", err)
+	}
+	encryptedKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: encryptedDER})
+
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("failed to write [%s]: [%s]", path, err)
+		}
+		return path
+	}
+
+	leafCertPath := writeFile("leaf.pem", leafPEM)
+	chainCertPath := writeFile("chain.pem", chainPEM)
+	plainKeyPath := writeFile("plain-key.pem", plainKeyPEM)
+	encryptedKeyPath := writeFile("encrypted-key.pem", encryptedKeyPEM)
+
+	tests := []struct {
+		name         string
+		settings     *Settings
+		wantChainLen int
+		wantErr      bool
+	}{
+		{
+			name:         "unencrypted key, single cert",
+			settings:     &Settings{ClientCert: leafCertPath, ClientKey: plainKeyPath},
+			wantChainLen: 1,
+		},
+		{
+			name:         "unencrypted key, full chain",
+			settings:     &Settings{ClientCert: chainCertPath, ClientKey: plainKeyPath},
+			wantChainLen: 2,
+		},
+		{
+			name:         "encrypted key, single cert",
+			settings:     &Settings{ClientCert: leafCertPath, ClientKey: encryptedKeyPath, KeyPassword: "s3cret"},
+			wantChainLen: 1,
+		},
+		{
+			name:         "encrypted key, full chain",
+			settings:     &Settings{ClientCert: chainCertPath, ClientKey: encryptedKeyPath, KeyPassword: "s3cret"},
+			wantChainLen: 2,
+		},
+		{
+			name:     "encrypted key, wrong password",
+			settings: &Settings{ClientCert: leafCertPath, ClientKey: encryptedKeyPath, KeyPassword: "wrong"},
+			wantErr:  true,
+		},
+		{
+			name:     "missing clientKey",
+			settings: &Settings{ClientCert: leafCertPath},
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := getClientCertificate(tt.settings)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: [%s]", err)
+			}
+			if len(cert.Certificate) != tt.wantChainLen {
+				t.Fatalf("expected chain of length [%d], got [%d]", tt.wantChainLen, len(cert.Certificate))
+			}
+			if cert.PrivateKey == nil {
+				t.Fatalf("expected PrivateKey to be populated")
+			}
+		})
+	}
+}
+
+func TestGetCerts(t *testing.T) {
+
+	certPEM, _ := generateTestCert(t, "ca", nil, nil)
+
+	dir := t.TempDir()
+	fileTrustStore := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(fileTrustStore, certPEM, 0600); err != nil {
+		t.Fatalf("failed to write trust store file: [%s]", err)
+	}
+
+	dirTrustStore := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dirTrustStore, "ca.pem"), certPEM, 0600); err != nil {
+		t.Fatalf("failed to write trust store directory entry: [%s]", err)
+	}
+
+	tests := []struct {
+		name     string
+		settings *Settings
+		wantErr  bool
+	}{
+		{name: "system pool", settings: &Settings{TrustStore: systemTrustStore}},
+		{name: "literal PEM string", settings: &Settings{TrustStore: string(certPEM)}},
+		{name: "single PEM file", settings: &Settings{TrustStore: fileTrustStore}},
+		{name: "directory of PEM files", settings: &Settings{TrustStore: dirTrustStore}},
+		{name: "trustStorePEM only", settings: &Settings{TrustStorePEM: certPEM}},
+		{name: "trustStore and trustStorePEM combined", settings: &Settings{TrustStore: systemTrustStore, TrustStorePEM: certPEM}},
+		{name: "no trust material configured", settings: &Settings{}, wantErr: true},
+		{name: "trustStore path does not exist", settings: &Settings{TrustStore: filepath.Join(dir, "missing.pem")}, wantErr: true},
+		{name: "literal PEM with no valid certs", settings: &Settings{TrustStore: "-----BEGIN CERTIFICATE-----\nbogus\n-----END CERTIFICATE-----"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := getCerts(testLogger, tt.settings)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: [%s]", err)
+			}
+			if pool == nil {
+				t.Fatalf("expected a non-nil cert pool")
+			}
+		})
+	}
+}
+
+func TestGetConnectionKey(t *testing.T) {
+
+	base := Settings{
+		BrokerUrls: "localhost:9092",
+		User:       "alice",
+		TrustStore: "system",
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s *Settings)
+	}{
+		{"password", func(s *Settings) { s.Password = "different" }},
+		{"keyPassword", func(s *Settings) { s.KeyPassword = "different" }},
+		{"saslMechanism", func(s *Settings) { s.SASLMechanism = "SCRAM-SHA-256" }},
+		{"securityProtocol", func(s *Settings) { s.SecurityProtocol = "SASL_SSL" }},
+		{"trustStorePEM", func(s *Settings) { s.TrustStorePEM = []byte("-----BEGIN CERTIFICATE-----") }},
+		{"compression", func(s *Settings) { s.Compression = "gzip" }},
+		{"requiredAcks", func(s *Settings) { s.RequiredAcks = "all" }},
+		{"idempotent", func(s *Settings) { s.Idempotent = true }},
+		{"maxMessageBytes", func(s *Settings) { s.MaxMessageBytes = 1000 }},
+		{"flushFrequency", func(s *Settings) { s.FlushFrequency = "100ms" }},
+		{"flushMessages", func(s *Settings) { s.FlushMessages = 10 }},
+		{"retryMax", func(s *Settings) { s.RetryMax = 10 }},
+	}
+
+	baseKey := getConnectionKey(&base)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modified := base
+			tt.modify(&modified)
+
+			if key := getConnectionKey(&modified); key == baseKey {
+				t.Fatalf("expected changing [%s] to change the connection key, but it didn't", tt.name)
+			}
+		})
+	}
+
+	t.Run("identical settings produce identical keys", func(t *testing.T) {
+		other := base
+		if getConnectionKey(&other) != baseKey {
+			t.Fatalf("expected identical Settings to produce identical keys")
+		}
+	})
+}
+
+func TestGetKafkaConnectionPoolingAndRefcounting(t *testing.T) {
+
+	settings := &Settings{BrokerUrls: "localhost:9092"}
+
+	first, err := getKafkaConnection(testLogger, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	second, err := getKafkaConnection(testLogger, settings)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+
+	firstHandle := first.(*pooledConnectionHandle)
+	secondHandle := second.(*pooledConnectionHandle)
+	if firstHandle.pooled != secondHandle.pooled {
+		t.Fatalf("expected identical Settings to share the same pooled connection")
+	}
+	if firstHandle.pooled.refCount != 2 {
+		t.Fatalf("expected refCount [2], got [%d]", firstHandle.pooled.refCount)
+	}
+
+	differentSettings := &Settings{BrokerUrls: "localhost:9092", User: "alice", Password: "s3cret", SASLMechanism: "SCRAM-SHA-256"}
+	third, err := getKafkaConnection(testLogger, differentSettings)
+	if err != nil {
+		t.Fatalf("unexpected error: [%s]", err)
+	}
+	thirdHandle := third.(*pooledConnectionHandle)
+	if thirdHandle.pooled == firstHandle.pooled {
+		t.Fatalf("expected differing SASLMechanism to produce a distinct pooled connection")
+	}
+
+	if err := first.Stop(); err != nil {
+		t.Fatalf("unexpected error releasing first handle: [%s]", err)
+	}
+	if firstHandle.pooled.refCount != 1 {
+		t.Fatalf("expected refCount [1] after releasing one of two references, got [%d]", firstHandle.pooled.refCount)
+	}
+	if _, ok := connections[firstHandle.key]; !ok {
+		t.Fatalf("expected the pooled connection to still be cached while references remain")
+	}
+
+	if err := second.Stop(); err != nil {
+		t.Fatalf("unexpected error releasing second handle: [%s]", err)
+	}
+	if _, ok := connections[firstHandle.key]; ok {
+		t.Fatalf("expected the pooled connection to be removed from the cache once its last reference is released")
+	}
+
+	if err := third.Stop(); err != nil {
+		t.Fatalf("unexpected error releasing third handle: [%s]", err)
+	}
+}